@@ -1,11 +1,17 @@
 package login
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/MakeNowJust/heredoc"
@@ -16,21 +22,161 @@ import (
 	"github.com/cli/cli/pkg/prompt"
 	"github.com/cli/cli/utils"
 	"github.com/spf13/cobra"
+	"github.com/zalando/go-keyring"
 )
 
+const (
+	secretStoreFile    = "file"
+	secretStoreKeyring = "keyring"
+
+	// placeholderAccount is the secret-store account name used to stash a
+	// freshly created token before we know which GitHub login it belongs to.
+	placeholderAccount = "default"
+)
+
+// TokenStore persists and retrieves gh auth tokens. The default
+// implementation writes through the hosts config file; --secret-store=keyring
+// instead delegates to the OS keychain, leaving only a sentinel in the hosts
+// file.
+type TokenStore interface {
+	Get(host, user string) (string, error)
+	Set(host, user, token string) error
+	Delete(host, user string) error
+}
+
+// fileTokenStore is today's default behavior: the token lives directly in
+// the hosts config file. It ignores the user argument since a host only
+// ever had a single oauth_token entry before credential storage existed.
+type fileTokenStore struct {
+	cfg config.Config
+}
+
+func (s *fileTokenStore) Get(host, _ string) (string, error) {
+	return s.cfg.Get(host, "oauth_token")
+}
+
+func (s *fileTokenStore) Set(host, _, token string) error {
+	return s.cfg.Set(host, "oauth_token", token)
+}
+
+func (s *fileTokenStore) Delete(host, _ string) error {
+	return s.cfg.Set(host, "oauth_token", "")
+}
+
+// keyringTokenStore stores tokens in the OS keychain (macOS Keychain,
+// Windows Credential Manager, libsecret on Linux) via go-keyring.
+type keyringTokenStore struct{}
+
+func (s *keyringTokenStore) service(host string) string {
+	return fmt.Sprintf("gh:%s", host)
+}
+
+func (s *keyringTokenStore) Get(host, user string) (string, error) {
+	return keyring.Get(s.service(host), user)
+}
+
+func (s *keyringTokenStore) Set(host, user, token string) error {
+	return keyring.Set(s.service(host), user, token)
+}
+
+func (s *keyringTokenStore) Delete(host, user string) error {
+	return keyring.Delete(s.service(host), user)
+}
+
+// keyringSentinel is the value recorded in the hosts file in place of a
+// plaintext token when the secret actually lives in the OS keychain.
+func keyringSentinel(host, user string) string {
+	return fmt.Sprintf("keyring:%s/%s", host, user)
+}
+
+func newTokenStore(name string, cfg config.Config) (TokenStore, error) {
+	switch name {
+	case "", secretStoreFile:
+		return &fileTokenStore{cfg: cfg}, nil
+	case secretStoreKeyring:
+		return &keyringTokenStore{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported --secret-store %q (must be %q or %q)", name, secretStoreFile, secretStoreKeyring)
+	}
+}
+
+// saveToken writes a freshly obtained token through store, recording which
+// secret store was used for the host so that future commands know where to
+// look. For keyring storage, the hosts file keeps the plaintext token (not
+// the keyring sentinel) until rememberCredential re-homes it under the real
+// login: loginRun still has to build an opts.HttpClient() off this same
+// config to verify scopes and look up the username, and that client reads
+// oauth_token from cfg, not the keyring.
+func saveToken(cfg config.Config, store TokenStore, hostname, secretStoreName, account, token string) error {
+	if err := cfg.Set(hostname, "secret_store", secretStoreName); err != nil {
+		return err
+	}
+
+	if _, ok := store.(*keyringTokenStore); ok {
+		if err := store.Set(hostname, account, token); err != nil {
+			return err
+		}
+		return cfg.Set(hostname, "oauth_token", token)
+	}
+
+	return store.Set(hostname, account, token)
+}
+
 // TODO extract desired scopes somewhere, also hardcoded in config_setup
 var expectedScopes = []string{"repo", "read:org"}
 
 // TODO should probably use default hostname from mislav's work
 const defaultHostname = "github.com"
 
+// oauthClientID is the public OAuth client ID gh uses for the device flow.
+const oauthClientID = "178c6fc778ccc68e1d6a"
+
 type LoginOptions struct {
 	HttpClient func() (*http.Client, error)
 	IO         *iostreams.IOStreams
 	Config     func() (config.Config, error)
 
-	Hostname string
-	Token    string
+	Hostname       string
+	Token          string
+	Device         bool
+	Scopes         []string
+	LegacyPassword bool
+	User           string
+	SecretStore    string
+}
+
+// credential is a single stored login for a host, modeled after git-bug's
+// auth.Credential. A host can hold more than one of these at a time so that
+// users can switch between accounts (e.g. "personal" vs "work-ghe") without
+// logging in again.
+type credential struct {
+	ID        string    `json:"id"`
+	Login     string    `json:"login"`
+	Token     string    `json:"token"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+type accessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Error       string `json:"error"`
+}
+
+type authorizationRequest struct {
+	Scopes []string `json:"scopes"`
+	Note   string   `json:"note"`
+}
+
+type authorizationResponse struct {
+	Token string `json:"token"`
 }
 
 func NewCmdLogin(f *cmdutil.Factory, runF func(*LoginOptions) error) *cobra.Command {
@@ -97,18 +243,51 @@ func NewCmdLogin(f *cmdutil.Factory, runF func(*LoginOptions) error) *cobra.Comm
 
 	cmd.Flags().StringVar(&opts.Hostname, "hostname", "", "The hostname of the GitHub instance to authenticate with")
 	cmd.Flags().Bool("with-token", false, "If specified, token is read from STDIN")
+	cmd.Flags().BoolVar(&opts.Device, "device", false, "Authenticate with a device code, for headless environments")
+	cmd.Flags().StringSliceVar(&opts.Scopes, "scopes", nil, "Additional authentication scopes to request")
+	cmd.Flags().BoolVar(&opts.LegacyPassword, "legacy-password", false, "Create a token from a username and password instead of using a browser (GitHub Enterprise only)")
+	cmd.Flags().StringVar(&opts.User, "user", "", "Name to store this login under, for hosts with more than one account")
+	cmd.Flags().StringVar(&opts.SecretStore, "secret-store", secretStoreFile, "Where to store the auth token: file or keyring")
 
 	return cmd
 }
 
+// mergeScopes returns the union of the given scope sets, preserving the
+// order scopes were first seen and dropping duplicates.
+func mergeScopes(scopeSets ...[]string) []string {
+	seen := map[string]bool{}
+	var merged []string
+	for _, scopes := range scopeSets {
+		for _, scope := range scopes {
+			if scope == "" || seen[scope] {
+				continue
+			}
+			seen[scope] = true
+			merged = append(merged, scope)
+		}
+	}
+	return merged
+}
+
 func loginRun(opts *LoginOptions) error {
 	cfg, err := opts.Config()
 	if err != nil {
 		return err
 	}
 
+	scopes := mergeScopes(expectedScopes, opts.Scopes)
+
+	secretStoreName := opts.SecretStore
+	if secretStoreName == "" {
+		secretStoreName = secretStoreFile
+	}
+	store, err := newTokenStore(secretStoreName, cfg)
+	if err != nil {
+		return err
+	}
+
 	if opts.Token != "" {
-		err := cfg.Set(opts.Hostname, "oauth_token", opts.Token)
+		err := saveToken(cfg, store, opts.Hostname, secretStoreName, placeholderAccount, opts.Token)
 		if err != nil {
 			return err
 		}
@@ -124,16 +303,29 @@ func loginRun(opts *LoginOptions) error {
 
 		apiClient := api.NewClientFromHTTP(httpClient)
 
-		hasScopes, _, err := apiClient.HasScopes(expectedScopes...)
+		hasScopes, _, err := apiClient.HasScopes(scopes...)
 		if err != nil {
 			return fmt.Errorf("could not verify token: %w", err)
 		}
 
 		if !hasScopes {
-			return fmt.Errorf("token missing at least one of the required scopes: %v", expectedScopes)
+			return fmt.Errorf("token missing at least one of the required scopes: %v", scopes)
+		}
+
+		login, err := api.CurrentLoginName(apiClient)
+		if err != nil {
+			return fmt.Errorf("error using api: %w", err)
+		}
+
+		if err := rememberCredential(cfg, store, opts.Hostname, opts.User, login, opts.Token, scopes); err != nil {
+			return err
+		}
+
+		if err := cfg.Set(opts.Hostname, "oauth_scopes", strings.Join(scopes, ",")); err != nil {
+			return err
 		}
 
-		return nil
+		return cfg.Write()
 	}
 
 	isTTY := opts.IO.IsStdoutTTY() && opts.IO.IsStdinTTY()
@@ -175,23 +367,84 @@ func loginRun(opts *LoginOptions) error {
 
 	fmt.Fprintf(opts.IO.ErrOut, "- Logging into %s\n", hostname)
 
-	var authMode int
-	err = prompt.SurveyAskOne(&survey.Select{
-		Message: "How would you like to authenticate?",
-		Options: []string{
-			"Login with a web browser",
-			"Paste an authentication token",
-		},
-	}, &authMode)
-	if err != nil {
-		return fmt.Errorf("could not prompt: %w", err)
+	isEnterpriseHost := hostname != defaultHostname
+	allowLegacyPassword := opts.LegacyPassword || isEnterpriseHost
+
+	authOptions := []string{
+		"Login with a web browser",
+		"Paste an authentication token",
+		"Login with a device code",
+	}
+	if allowLegacyPassword {
+		authOptions = append(authOptions, "Create a token with your GitHub password")
+	}
+
+	authMode := 0
+	if opts.Device {
+		authMode = 2
+	} else if opts.LegacyPassword {
+		authMode = 3
+	} else {
+		err = prompt.SurveyAskOne(&survey.Select{
+			Message: "How would you like to authenticate?",
+			Options: authOptions,
+		}, &authMode)
+		if err != nil {
+			return fmt.Errorf("could not prompt: %w", err)
+		}
 	}
 
 	if authMode == 0 {
+		// TODO AuthFlowWithConfig's oauth.Flow setup doesn't accept a scopes
+		// list yet, so --scopes is ignored here; authFlowDeviceCode and
+		// authFlowLegacyPassword below already thread scopes through, but
+		// the browser flow needs a change in internal/config too.
 		_, err := config.AuthFlowWithConfig(cfg, hostname, "")
 		if err != nil {
 			return fmt.Errorf("failed to authenticate via web browser: %w", err)
 		}
+	} else if authMode == 2 {
+		httpClient, err := opts.HttpClient()
+		if err != nil {
+			return err
+		}
+
+		token, err := authFlowDeviceCode(httpClient, opts.IO, hostname, scopes)
+		if err != nil {
+			return fmt.Errorf("failed to authenticate via device code: %w", err)
+		}
+
+		err = saveToken(cfg, store, hostname, secretStoreName, placeholderAccount, token)
+		if err != nil {
+			return err
+		}
+		err = cfg.Write()
+		if err != nil {
+			return err
+		}
+	} else if authMode == 3 {
+		if !allowLegacyPassword {
+			return errors.New("creating a token from a password is only supported on GitHub Enterprise; pass --legacy-password to override")
+		}
+
+		httpClient, err := opts.HttpClient()
+		if err != nil {
+			return err
+		}
+
+		token, err := authFlowLegacyPassword(httpClient, opts.IO, hostname, scopes)
+		if err != nil {
+			return fmt.Errorf("failed to authenticate with username and password: %w", err)
+		}
+
+		err = saveToken(cfg, store, hostname, secretStoreName, placeholderAccount, token)
+		if err != nil {
+			return err
+		}
+		err = cfg.Write()
+		if err != nil {
+			return err
+		}
 	} else {
 		fmt.Fprintln(opts.IO.ErrOut)
 		fmt.Fprintln(opts.IO.ErrOut, heredoc.Doc(`
@@ -205,7 +458,7 @@ func loginRun(opts *LoginOptions) error {
 			return fmt.Errorf("could not prompt: %w", err)
 		}
 
-		err = cfg.Set(opts.Hostname, "oauth_token", token)
+		err = saveToken(cfg, store, opts.Hostname, secretStoreName, placeholderAccount, token)
 		if err != nil {
 			return err
 		}
@@ -221,17 +474,22 @@ func loginRun(opts *LoginOptions) error {
 
 		apiClient := api.NewClientFromHTTP(httpClient)
 
-		hasScopes, _, err := apiClient.HasScopes(expectedScopes...)
+		hasScopes, _, err := apiClient.HasScopes(scopes...)
 		if err != nil {
 			return fmt.Errorf("could not verify token: %w", err)
 		}
 
 		if !hasScopes {
 			return fmt.Errorf("%s token missing at least one of the required scopes: %v",
-				utils.Red("!"), expectedScopes)
+				utils.Red("!"), scopes)
 		}
 	}
 
+	err = cfg.Set(hostname, "oauth_scopes", strings.Join(scopes, ","))
+	if err != nil {
+		return err
+	}
+
 	var gitProtocol string
 	err = prompt.SurveyAskOne(&survey.Select{
 		Message: "Choose default git protocol",
@@ -272,7 +530,275 @@ func loginRun(opts *LoginOptions) error {
 		return fmt.Errorf("error using api: %w", err)
 	}
 
+	token, _ := store.Get(hostname, placeholderAccount)
+	if token == "" {
+		token, _ = cfg.Get(hostname, "oauth_token")
+	}
+
+	if token != "" {
+		if err := rememberCredential(cfg, store, hostname, opts.User, username, token, scopes); err != nil {
+			return err
+		}
+		if err := cfg.Write(); err != nil {
+			return err
+		}
+	}
+
 	fmt.Fprintf(opts.IO.ErrOut, "%s Logged in as %s\n", greenCheck, utils.Bold(username))
 
 	return nil
 }
+
+// deviceAndTokenURLs returns the device code and access token endpoints for
+// the given hostname, accounting for GitHub Enterprise instances.
+func deviceAndTokenURLs(hostname string) (string, string) {
+	if hostname == defaultHostname {
+		return "https://github.com/login/device/code", "https://github.com/login/oauth/access_token"
+	}
+
+	return fmt.Sprintf("https://%s/login/device/code", hostname),
+		fmt.Sprintf("https://%s/login/oauth/access_token", hostname)
+}
+
+// authFlowDeviceCode implements GitHub's OAuth device flow: it requests a
+// device code, displays the verification URL and user code for the user to
+// enter, then polls until the user has authorized the device (or the
+// request expires).
+func authFlowDeviceCode(httpClient *http.Client, io *iostreams.IOStreams, hostname string, scopes []string) (string, error) {
+	deviceCodeURL, accessTokenURL := deviceAndTokenURLs(hostname)
+
+	resp, err := httpClient.PostForm(deviceCodeURL, url.Values{
+		"client_id": {oauthClientID},
+		"scope":     {strings.Join(scopes, " ")},
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not request device code: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not request device code: unexpected status %d", resp.StatusCode)
+	}
+
+	var dcr deviceCodeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&dcr); err != nil {
+		return "", fmt.Errorf("could not parse device code response: %w", err)
+	}
+
+	fmt.Fprintf(io.ErrOut, "First copy your one-time code: %s\n", utils.Bold(dcr.UserCode))
+	fmt.Fprintf(io.ErrOut, "- Then open %s in your browser\n", utils.Bold(dcr.VerificationURI))
+
+	interval := time.Duration(dcr.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+
+	for {
+		time.Sleep(interval)
+
+		resp, err := httpClient.PostForm(accessTokenURL, url.Values{
+			"client_id":   {oauthClientID},
+			"device_code": {dcr.DeviceCode},
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		})
+		if err != nil {
+			return "", fmt.Errorf("could not poll for access token: %w", err)
+		}
+
+		var atr accessTokenResponse
+		err = json.NewDecoder(resp.Body).Decode(&atr)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("could not parse access token response: %w", err)
+		}
+
+		switch atr.Error {
+		case "":
+			if atr.AccessToken != "" {
+				return atr.AccessToken, nil
+			}
+		case "authorization_pending":
+			// keep polling at the same interval
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return "", fmt.Errorf("failed to authenticate: %s", atr.Error)
+		}
+	}
+}
+
+// authorizationsURL returns the API endpoint for creating a Personal Access
+// Token from a username and password, accounting for GitHub Enterprise
+// instances.
+func authorizationsURL(hostname string) string {
+	if hostname == defaultHostname {
+		return "https://api.github.com/authorizations"
+	}
+
+	return fmt.Sprintf("https://%s/api/v3/authorizations", hostname)
+}
+
+// randomSuffix generates a short random hex string used to keep generated
+// token names unique.
+func randomSuffix() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authFlowLegacyPassword creates a Personal Access Token on the user's
+// behalf via the legacy /authorizations API, prompting for a username,
+// password, and (if required) a two-factor OTP code. This endpoint is only
+// available on GitHub Enterprise; github.com removed it in favor of OAuth.
+func authFlowLegacyPassword(httpClient *http.Client, io *iostreams.IOStreams, hostname string, scopes []string) (string, error) {
+	var username string
+	err := prompt.SurveyAskOne(&survey.Input{
+		Message: "Username:",
+	}, &username, survey.WithValidator(survey.Required))
+	if err != nil {
+		return "", fmt.Errorf("could not prompt: %w", err)
+	}
+
+	var password string
+	err = prompt.SurveyAskOne(&survey.Password{
+		Message: "Password:",
+	}, &password, survey.WithValidator(survey.Required))
+	if err != nil {
+		return "", fmt.Errorf("could not prompt: %w", err)
+	}
+
+	suffix, err := randomSuffix()
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(authorizationRequest{
+		Scopes: scopes,
+		Note:   fmt.Sprintf("gh-cli:%s-%s", hostname, suffix),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	otp := ""
+	for {
+		req, err := http.NewRequest("POST", authorizationsURL(hostname), bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		req.SetBasicAuth(username, password)
+		req.Header.Set("Content-Type", "application/json")
+		if otp != "" {
+			req.Header.Set("X-GitHub-OTP", otp)
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("could not create token: %w", err)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("X-GitHub-OTP") != "" {
+			resp.Body.Close()
+			fmt.Fprintln(io.ErrOut, "- Two-factor authentication is enabled on your account")
+			err := prompt.SurveyAskOne(&survey.Input{
+				Message: "Two-factor authentication code:",
+			}, &otp, survey.WithValidator(survey.Required))
+			if err != nil {
+				return "", fmt.Errorf("could not prompt: %w", err)
+			}
+			continue
+		}
+
+		if resp.StatusCode != http.StatusCreated {
+			resp.Body.Close()
+			return "", fmt.Errorf("could not create token: unexpected status %d", resp.StatusCode)
+		}
+
+		var ar authorizationResponse
+		err = json.NewDecoder(resp.Body).Decode(&ar)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("could not parse authorization response: %w", err)
+		}
+
+		return ar.Token, nil
+	}
+}
+
+// loadCredentials returns the credentials stored for a host, keyed by
+// credential id. If the host has never been migrated to the multi-account
+// format, a legacy single oauth_token (if any) is surfaced as a "default"
+// credential.
+func loadCredentials(cfg config.Config, hostname string) (map[string]credential, error) {
+	creds := map[string]credential{}
+
+	if blob, err := cfg.Get(hostname, "users"); err == nil && blob != "" {
+		if err := json.Unmarshal([]byte(blob), &creds); err != nil {
+			return nil, fmt.Errorf("could not parse stored credentials: %w", err)
+		}
+		return creds, nil
+	}
+
+	if token, err := cfg.Get(hostname, "oauth_token"); err == nil && token != "" {
+		creds[placeholderAccount] = credential{ID: placeholderAccount, Token: token}
+	}
+
+	return creds, nil
+}
+
+// rememberCredential records a login under the given hostname, keyed by id
+// (falling back to the GitHub login name when id is empty), and marks it as
+// the default credential other gh commands should use for that host. token
+// is the plaintext secret as returned by the auth flow; if store is a
+// keyring, the secret is re-homed from the placeholder account it was
+// written under during login to its final, login-derived account.
+func rememberCredential(cfg config.Config, store TokenStore, hostname, id, login, token string, scopes []string) error {
+	creds, err := loadCredentials(cfg, hostname)
+	if err != nil {
+		return err
+	}
+
+	if id == "" {
+		id = login
+	}
+
+	// loadCredentials synthesizes a "default" entry from a legacy
+	// single-token host. Once we know the real login, that synthetic entry
+	// would otherwise stick around as a dead duplicate forever.
+	if id != placeholderAccount {
+		delete(creds, placeholderAccount)
+	}
+
+	storedToken := token
+	if _, ok := store.(*keyringTokenStore); ok && id != placeholderAccount {
+		if err := store.Set(hostname, id, token); err != nil {
+			return err
+		}
+		_ = store.Delete(hostname, placeholderAccount)
+		if err := cfg.Set(hostname, "oauth_token", keyringSentinel(hostname, id)); err != nil {
+			return err
+		}
+		storedToken = keyringSentinel(hostname, id)
+	}
+
+	creds[id] = credential{
+		ID:        id,
+		Login:     login,
+		Token:     storedToken,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+
+	blob, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.Set(hostname, "users", string(blob)); err != nil {
+		return err
+	}
+
+	return cfg.Set(hostname, "user", id)
+}
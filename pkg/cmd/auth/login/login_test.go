@@ -12,6 +12,7 @@ import (
 	"github.com/cli/cli/pkg/iostreams"
 	"github.com/google/shlex"
 	"github.com/stretchr/testify/assert"
+	"github.com/zalando/go-keyring"
 )
 
 func Test_NewCmdLogin(t *testing.T) {
@@ -203,6 +204,130 @@ func Test_loginRun(t *testing.T) {
 	}
 }
 
+func Test_mergeScopes(t *testing.T) {
+	tests := []struct {
+		name string
+		sets [][]string
+		want []string
+	}{
+		{
+			name: "dedupes across sets, preserving first-seen order",
+			sets: [][]string{{"repo", "read:org"}, {"read:org", "gist"}},
+			want: []string{"repo", "read:org", "gist"},
+		},
+		{
+			name: "drops empty scopes",
+			sets: [][]string{{"repo", ""}, {""}},
+			want: []string{"repo"},
+		},
+		{
+			name: "no sets",
+			sets: nil,
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, mergeScopes(tt.sets...))
+		})
+	}
+}
+
+func Test_newTokenStore(t *testing.T) {
+	cfg := config.NewBlankConfig()
+
+	store, err := newTokenStore("", cfg)
+	assert.NoError(t, err)
+	assert.IsType(t, &fileTokenStore{}, store)
+
+	store, err = newTokenStore(secretStoreFile, cfg)
+	assert.NoError(t, err)
+	assert.IsType(t, &fileTokenStore{}, store)
+
+	store, err = newTokenStore(secretStoreKeyring, cfg)
+	assert.NoError(t, err)
+	assert.IsType(t, &keyringTokenStore{}, store)
+
+	_, err = newTokenStore("carrier-pigeon", cfg)
+	assert.Error(t, err)
+}
+
+func Test_loadCredentials(t *testing.T) {
+	t.Run("no stored credentials", func(t *testing.T) {
+		cfg := config.NewBlankConfig()
+
+		creds, err := loadCredentials(cfg, "github.com")
+		assert.NoError(t, err)
+		assert.Empty(t, creds)
+	})
+
+	t.Run("legacy single oauth_token is surfaced under the placeholder id", func(t *testing.T) {
+		cfg := config.NewBlankConfig()
+		assert.NoError(t, cfg.Set("github.com", "oauth_token", "abc123"))
+
+		creds, err := loadCredentials(cfg, "github.com")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]credential{
+			placeholderAccount: {ID: placeholderAccount, Token: "abc123"},
+		}, creds)
+	})
+
+	t.Run("prefers the multi-account users blob once migrated", func(t *testing.T) {
+		cfg := config.NewBlankConfig()
+		assert.NoError(t, cfg.Set("github.com", "oauth_token", "abc123"))
+		assert.NoError(t, cfg.Set("github.com", "users", `{"monalisa":{"id":"monalisa","login":"monalisa","token":"def456"}}`))
+
+		creds, err := loadCredentials(cfg, "github.com")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]credential{
+			"monalisa": {ID: "monalisa", Login: "monalisa", Token: "def456"},
+		}, creds)
+	})
+}
+
+func Test_rememberCredential(t *testing.T) {
+	t.Run("replaces the legacy placeholder entry with the real login", func(t *testing.T) {
+		cfg := config.NewBlankConfig()
+		assert.NoError(t, cfg.Set("github.com", "oauth_token", "abc123"))
+		store := &fileTokenStore{cfg: cfg}
+
+		err := rememberCredential(cfg, store, "github.com", "", "monalisa", "abc123", []string{"repo"})
+		assert.NoError(t, err)
+
+		creds, err := loadCredentials(cfg, "github.com")
+		assert.NoError(t, err)
+		assert.Len(t, creds, 1)
+		assert.Contains(t, creds, "monalisa")
+		assert.NotContains(t, creds, placeholderAccount)
+	})
+
+	t.Run("re-homes the keyring secret and drops the placeholder entry", func(t *testing.T) {
+		keyring.MockInit()
+
+		cfg := config.NewBlankConfig()
+		assert.NoError(t, cfg.Set("github.com", "oauth_token", "abc123"))
+		store := &keyringTokenStore{}
+		assert.NoError(t, store.Set("github.com", placeholderAccount, "abc123"))
+
+		err := rememberCredential(cfg, store, "github.com", "", "monalisa", "abc123", []string{"repo"})
+		assert.NoError(t, err)
+
+		creds, err := loadCredentials(cfg, "github.com")
+		assert.NoError(t, err)
+		assert.NotContains(t, creds, placeholderAccount)
+		assert.Contains(t, creds, "monalisa")
+
+		rehomed, err := store.Get("github.com", "monalisa")
+		assert.NoError(t, err)
+		assert.Equal(t, "abc123", rehomed)
+
+		if _, err := store.Get("github.com", placeholderAccount); err == nil {
+			t.Error("expected placeholder keyring entry to be deleted")
+		}
+	})
+}
+
 /*
 func Test_loginRun_ConfiguresProtocol(t *testing.T) {
 	io, _, _, _ := iostreams.Test()